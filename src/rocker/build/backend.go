@@ -0,0 +1,262 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"rocker/parser"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Backend abstracts the operations Builder needs in order to turn a
+// parsed Rockerfile into image layers: building an image from a build
+// context, pulling and pushing images, inspecting and listing them, and
+// creating/running/committing the containers a build step (or the
+// tar-streaming EXPORT/IMPORT path) needs.
+//
+// DockerBackend is the default implementation and delegates everything
+// to a Docker daemon through go-dockerclient, the way Rocker has always
+// worked. ImagebuilderBackend is a daemonless alternative that
+// interprets the Rockerfile AST itself.
+type Backend interface {
+	// BuildImage builds an image described by req and returns the
+	// resulting image id.
+	BuildImage(req BuildRequest) (string, error)
+
+	// PullImage pulls an image from a registry.
+	PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error
+
+	// PushImage pushes an image to a registry.
+	PushImage(opts docker.PushImageOptions, auth docker.AuthConfiguration) error
+
+	// InspectImage returns image metadata, or a "no such image" error if
+	// it does not exist.
+	InspectImage(name string) (*docker.Image, error)
+
+	// ListImages lists the images known to the backend.
+	ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error)
+
+	// CreateContainer creates a container without starting it.
+	CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error)
+
+	// RemoveContainer removes a container, e.g. one created as scratch
+	// space for a RUN/COPY step or for EXPORT/IMPORT.
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+
+	// StartContainer starts a previously created container.
+	StartContainer(id string, hostConfig *docker.HostConfig) error
+
+	// WaitContainer blocks until a container exits and returns its exit
+	// code.
+	WaitContainer(id string) (int, error)
+
+	// CommitContainer commits a container's filesystem as a new image.
+	CommitContainer(opts docker.CommitContainerOptions) (*docker.Image, error)
+
+	// CopyFromContainer streams a path out of a container as a tar
+	// archive.
+	CopyFromContainer(opts docker.CopyFromContainerOptions) error
+
+	// UploadToContainer unpacks a tar archive into a path inside a
+	// container.
+	UploadToContainer(container string, opts docker.UploadToContainerOptions) error
+}
+
+// BuildRequest carries everything a Backend needs in order to build a
+// single image. Dockerfile is the parsed AST, so a daemonless backend
+// can interpret it directly instead of shipping it to a daemon; Options
+// is what a daemon-backed backend passes through to the Docker build
+// API unchanged.
+type BuildRequest struct {
+	Dockerfile *parser.Node
+	Options    docker.BuildImageOptions
+}
+
+// captureImageID is a fallback for daemons that don't emit an aux ID
+// message on the final build step (older Docker versions, non-English
+// locales, or anything that changes the "Successfully built" wording
+// would otherwise break this, which is exactly why it's a fallback and
+// not the primary path anymore).
+var (
+	captureImageID = regexp.MustCompile("Successfully built ([a-z0-9]{12})")
+)
+
+// DockerBackend is the original Backend implementation: it hands the
+// build context off to the Docker daemon's own build engine and relies
+// on go-dockerclient for everything else.
+type DockerBackend struct {
+	Docker *docker.Client
+
+	OutStream     io.Writer
+	fdOut         uintptr
+	isTerminalOut bool
+}
+
+// NewDockerBackend makes a DockerBackend bound to an existing Docker
+// client connection.
+func NewDockerBackend(client *docker.Client, outStream io.Writer, fdOut uintptr, isTerminalOut bool) *DockerBackend {
+	return &DockerBackend{
+		Docker:        client,
+		OutStream:     outStream,
+		fdOut:         fdOut,
+		isTerminalOut: isTerminalOut,
+	}
+}
+
+// BuildImage runs req.Options through the Docker daemon's build engine
+// and reads the resulting image id straight out of the "aux" field
+// Docker emits on the final build step (`{"ID":"sha256:..."}`), rather
+// than scraping it out of the "Successfully built" line of the human-
+// readable output. That line breaks on non-English daemons, BuildKit
+// output, and any future wording change, and it only ever carried a
+// 12-char truncated id anyway; the aux field carries the full digest.
+//
+// jsonmessage.DisplayJSONMessagesStream doesn't hand aux messages back
+// to its caller in the vendored version of that package, so rather than
+// depend on an aux-callback parameter that isn't there, the build
+// output is teed into a buffer and decoded a second time afterwards,
+// independently of what DisplayJSONMessagesStream did with it.
+func (b *DockerBackend) BuildImage(req BuildRequest) (string, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	var buf bytes.Buffer
+	opts := req.Options
+	opts.OutputStream = io.MultiWriter(pipeWriter, &buf)
+
+	errch := make(chan error)
+
+	go func() {
+		err := b.Docker.BuildImage(opts)
+
+		if err := pipeWriter.Close(); err != nil {
+			fmt.Fprintf(b.OutStream, "pipeWriter.Close() err: %s\n", err)
+		}
+
+		errch <- err
+	}()
+
+	if err := jsonmessage.DisplayJSONMessagesStream(pipeReader, b.OutStream, b.fdOut, b.isTerminalOut); err != nil {
+		return "", fmt.Errorf("Failed to process json stream error: %s", err)
+	}
+
+	if err := <-errch; err != nil {
+		return "", fmt.Errorf("Failed to build image: %s", err)
+	}
+
+	if imageID := findAuxImageID(buf.Bytes()); imageID != "" {
+		return imageID, nil
+	}
+
+	// Fall back to the old regex only if no aux message was seen at all
+	// (older Docker versions that don't emit one).
+	matches := captureImageID.FindStringSubmatch(buf.String())
+	if len(matches) == 0 {
+		return "", fmt.Errorf("Couldn't find image id out of docker build output")
+	}
+
+	return matches[1], nil
+}
+
+// findAuxImageID decodes raw as a stream of JSON build messages (the
+// same bytes DisplayJSONMessagesStream just consumed) and returns the
+// image id from the last "aux" field seen, or "" if none was.
+func findAuxImageID(raw []byte) string {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+
+	var imageID string
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			break
+		}
+		if msg.Aux == nil {
+			continue
+		}
+
+		var aux struct {
+			ID string `json:"ID"`
+		}
+		if err := json.Unmarshal(*msg.Aux, &aux); err == nil && aux.ID != "" {
+			imageID = aux.ID
+		}
+	}
+
+	return strings.TrimPrefix(imageID, "sha256:")
+}
+
+// PullImage delegates to the Docker client unchanged.
+func (b *DockerBackend) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	return b.Docker.PullImage(opts, auth)
+}
+
+// PushImage delegates to the Docker client unchanged.
+func (b *DockerBackend) PushImage(opts docker.PushImageOptions, auth docker.AuthConfiguration) error {
+	return b.Docker.PushImage(opts, auth)
+}
+
+// InspectImage delegates to the Docker client unchanged.
+func (b *DockerBackend) InspectImage(name string) (*docker.Image, error) {
+	return b.Docker.InspectImage(name)
+}
+
+// ListImages delegates to the Docker client unchanged.
+func (b *DockerBackend) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	return b.Docker.ListImages(opts)
+}
+
+// CreateContainer delegates to the Docker client unchanged.
+func (b *DockerBackend) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	return b.Docker.CreateContainer(opts)
+}
+
+// RemoveContainer delegates to the Docker client unchanged.
+func (b *DockerBackend) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	return b.Docker.RemoveContainer(opts)
+}
+
+// StartContainer delegates to the Docker client unchanged.
+func (b *DockerBackend) StartContainer(id string, hostConfig *docker.HostConfig) error {
+	return b.Docker.StartContainer(id, hostConfig)
+}
+
+// WaitContainer delegates to the Docker client unchanged.
+func (b *DockerBackend) WaitContainer(id string) (int, error) {
+	return b.Docker.WaitContainer(id)
+}
+
+// CommitContainer delegates to the Docker client unchanged.
+func (b *DockerBackend) CommitContainer(opts docker.CommitContainerOptions) (*docker.Image, error) {
+	return b.Docker.CommitContainer(opts)
+}
+
+// CopyFromContainer delegates to the Docker client unchanged.
+func (b *DockerBackend) CopyFromContainer(opts docker.CopyFromContainerOptions) error {
+	return b.Docker.CopyFromContainer(opts)
+}
+
+// UploadToContainer delegates to the Docker client unchanged.
+func (b *DockerBackend) UploadToContainer(container string, opts docker.UploadToContainerOptions) error {
+	return b.Docker.UploadToContainer(container, opts)
+}
@@ -0,0 +1,291 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rocker/parser"
+
+	"github.com/boltdb/bolt"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// cacheKeyLabel is the label runDockerfile stamps on the image it builds
+// when the cache is in use (intermediate images committed along the way
+// don't carry it). Its value is the content-addressable cache key described below, so a
+// later build (even against an image pulled from a registry, where
+// ParentID and history are gone) can probe for a hit with a single
+// lookup instead of scanning every local image.
+const cacheKeyLabel = "rocker.cache.key"
+
+// cacheBucket is the boltdb bucket rocker's local cache index lives in,
+// used as a fallback for daemons/registries that strip labels.
+var cacheBucket = []byte("cache")
+
+// cacheKeyInput is hashed to produce a cache key. Keeping the fields
+// explicit (rather than hashing the whole docker.Config) means adding
+// an irrelevant Config field later doesn't silently bust every
+// existing cache.
+type cacheKeyInput struct {
+	ParentID    string            `json:"parent_id"`
+	Instruction string            `json:"instruction"`
+	Cmd         []string          `json:"cmd,omitempty"`
+	Entrypoint  []string          `json:"entrypoint,omitempty"`
+	Env         []string          `json:"env,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	WorkingDir  string            `json:"working_dir,omitempty"`
+	User        string            `json:"user,omitempty"`
+	SourcesSum  string            `json:"sources_sum,omitempty"`
+}
+
+// computeCacheKey derives a stable digest for the instruction about to
+// run on top of parentID. For COPY/ADD, sourcesTarSum should be a
+// tar-sum of the resolved source files so that changing file contents
+// busts the cache even though the instruction text itself didn't
+// change.
+func computeCacheKey(parentID string, instruction string, config *docker.Config, sourcesTarSum string) (string, error) {
+	input := cacheKeyInput{
+		ParentID:    parentID,
+		Instruction: instruction,
+		Cmd:         config.Cmd,
+		Entrypoint:  config.Entrypoint,
+		Env:         config.Env,
+		Labels:      config.Labels,
+		WorkingDir:  config.WorkingDir,
+		User:        config.User,
+		SourcesSum:  sourcesTarSum,
+	}
+
+	data, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// collectCopyAddSources walks root's children and returns every local
+// source path (resolved relative to ContextDir) referenced by a COPY or
+// ADD instruction, so the cache key can be hashed over what those
+// instructions actually read rather than the unrelated MOUNT bind list.
+// The final argument of each COPY/ADD is its destination and is
+// skipped; leading "--flag=..." args (e.g. COPY --from=builder) are
+// skipped too since they don't name a path under ContextDir. ADD also
+// accepts a remote URL as its source (`ADD https://example.com/f /dest`)
+// — those aren't resolvable under ContextDir, so they're left out of
+// the hash rather than stat'd as a local path.
+func collectCopyAddSources(root *parser.Node) []string {
+	if root == nil {
+		return nil
+	}
+
+	var sources []string
+	for _, node := range root.Children {
+		directive := strings.ToLower(node.Value)
+		if directive != "copy" && directive != "add" {
+			continue
+		}
+
+		var args []string
+		for n := node.Next; n != nil; n = n.Next {
+			if strings.HasPrefix(n.Value, "--") {
+				continue
+			}
+			args = append(args, n.Value)
+		}
+
+		// last arg is the destination, not a source
+		if len(args) > 1 {
+			for _, src := range args[:len(args)-1] {
+				if isRemoteSource(src) {
+					continue
+				}
+				sources = append(sources, src)
+			}
+		}
+	}
+
+	return sources
+}
+
+// isRemoteSource reports whether an ADD source is a remote URL rather
+// than a path under ContextDir.
+func isRemoteSource(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// tarSumFiles computes a stable digest over the contents of files,
+// identified by their path relative to contextDir. Directories are
+// walked recursively so that a change anywhere inside a COPY'd/ADDed
+// tree busts the cache, not just a change to the directory's own
+// metadata. It is used to fold COPY/ADD source contents into the cache
+// key, the same way imagebuilder/buildah hash build context input for
+// reproducible caching.
+func tarSumFiles(contextDir string, relPaths []string) (string, error) {
+	sorted := append([]string{}, relPaths...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, rel := range sorted {
+		fullPath := filepath.Join(contextDir, rel)
+
+		if err := hashPath(h, fullPath, rel); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashPath writes a digest of fullPath into h, identifying it by name
+// (its path relative to contextDir). Directories are walked
+// recursively, each regular file contributing its own name/size/mtime
+// and contents.
+func hashPath(h io.Writer, fullPath, name string) error {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return hashFile(h, fullPath, name, info)
+	}
+
+	return filepath.Walk(fullPath, func(walkPath string, walkInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if walkInfo.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(fullPath, walkPath)
+		if err != nil {
+			return err
+		}
+
+		return hashFile(h, walkPath, filepath.ToSlash(filepath.Join(name, rel)), walkInfo)
+	})
+}
+
+// hashFile writes a single regular file's name/size/mtime and contents
+// into h.
+func hashFile(h io.Writer, fullPath, name string, info os.FileInfo) error {
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00", name, info.Size(), info.ModTime().UnixNano())
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// boltCacheStore is a local fallback index from cache key to image id,
+// used when the registry or daemon in front of us strips image labels
+// on push/pull. It lives under the Rocker state dir.
+type boltCacheStore struct {
+	path string
+}
+
+func newBoltCacheStore(stateDir string) *boltCacheStore {
+	return &boltCacheStore{path: filepath.Join(stateDir, "cache.db")}
+}
+
+func (s *boltCacheStore) withDB(fn func(*bolt.DB) error) error {
+	db, err := bolt.Open(s.path, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return fn(db)
+}
+
+func (s *boltCacheStore) get(key string) (string, error) {
+	var imageID string
+	err := s.withDB(func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(cacheBucket)
+			if b == nil {
+				return nil
+			}
+			imageID = string(b.Get([]byte(key)))
+			return nil
+		})
+	})
+	return imageID, err
+}
+
+func (s *boltCacheStore) put(key, imageID string) error {
+	return s.withDB(func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(cacheBucket)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(key), []byte(imageID))
+		})
+	})
+}
+
+// imageGetCachedByKey looks up an image directly by its content
+// cache key: first by scanning local images for the rocker.cache.key
+// label (a single ListImages call, no per-sibling InspectImage
+// fan-out), then, if that misses, through the local boltdb index that
+// survives pulls from a registry which doesn't preserve labels.
+func (builder *Builder) imageGetCachedByKey(key string) (*docker.Image, error) {
+	images, err := builder.Backend.ListImages(docker.ListImagesOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, img := range images {
+		if img.Labels[cacheKeyLabel] == key {
+			return builder.Backend.InspectImage(img.ID)
+		}
+	}
+
+	if builder.cache == nil {
+		return nil, nil
+	}
+
+	imageID, err := builder.cache.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if imageID == "" {
+		return nil, nil
+	}
+
+	image, err := builder.Backend.InspectImage(imageID)
+	if err != nil && err.Error() == "no such image" {
+		return nil, nil
+	}
+	return image, err
+}
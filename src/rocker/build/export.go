@@ -0,0 +1,91 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// exportsHelperImage backs the exports container now that EXPORT/IMPORT
+// stream tar archives directly between containers: all it needs from an
+// image is something minimal to create a container against, since no
+// binary is executed inside it anymore. "scratch" can't be used here —
+// it's a build-time pseudo-base the Docker build engine special-cases,
+// not a real image you can CreateContainer against — so this keeps a
+// tiny real image around instead, the same way rsyncImage used to.
+const exportsHelperImage = "busybox"
+
+// tarStreamExport copies srcPath out of srcContainerID and into destPath
+// inside destContainerID by piping the tar stream Backend's own
+// CopyFromContainer/UploadToContainer produce, without landing it on
+// the host or routing it through a helper container running rsync. This
+// mirrors how imagebuilder's archive handling moves files between build
+// stages, and goes through builder.Backend rather than builder.Docker
+// directly so the daemonless backend can serve EXPORT/IMPORT too.
+func (builder *Builder) tarStreamExport(srcContainerID, srcPath, destContainerID, destPath string) error {
+	pipeReader, pipeWriter := io.Pipe()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		err := builder.Backend.CopyFromContainer(docker.CopyFromContainerOptions{
+			OutputStream: pipeWriter,
+			Container:    srcContainerID,
+			Resource:     srcPath,
+		})
+		pipeWriter.CloseWithError(err)
+		errCh <- err
+	}()
+
+	if err := builder.Backend.UploadToContainer(destContainerID, docker.UploadToContainerOptions{
+		InputStream: pipeReader,
+		Path:        destPath,
+	}); err != nil {
+		return fmt.Errorf("Failed to stream %s from container %.12s to %s on container %.12s, error: %s",
+			srcPath, srcContainerID, destPath, destContainerID, err)
+	}
+
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("Failed to read %s from container %.12s, error: %s", srcPath, srcContainerID, err)
+	}
+
+	return nil
+}
+
+// exportToHost copies srcPath out of srcContainerID into the exports
+// container's shared volume, the tar-streaming equivalent of what an
+// rsync helper container used to do over a shared volume mount.
+func (builder *Builder) exportToHost(srcContainerID, srcPath, destPath string) error {
+	exportsContainerID, err := builder.makeExportsContainer()
+	if err != nil {
+		return err
+	}
+	return builder.tarStreamExport(srcContainerID, srcPath, exportsContainerID, destPath)
+}
+
+// importFromHost copies srcPath out of the exports container's shared
+// volume into destPath inside destContainerID.
+func (builder *Builder) importFromHost(srcPath, destContainerID, destPath string) error {
+	exportsContainerID, err := builder.makeExportsContainer()
+	if err != nil {
+		return err
+	}
+	return builder.tarStreamExport(exportsContainerID, srcPath, destContainerID, destPath)
+}
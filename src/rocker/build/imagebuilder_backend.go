@@ -0,0 +1,427 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"rocker/parser"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ImagebuilderBackend is a daemonless Backend: instead of shipping the
+// Rockerfile off to the Docker daemon's build engine, it walks the
+// parsed AST node by node and, for each directive, creates (or reuses)
+// a container from the current image, applies the directive to it, and
+// commits the result as the new current image. This is the same
+// approach taken by imagebuilder and buildah, and it gives Rocker
+// control over its own layering and caching independent of whatever
+// build implementation a particular Docker daemon happens to ship.
+type ImagebuilderBackend struct {
+	Docker *docker.Client
+
+	OutStream io.Writer
+}
+
+// NewImagebuilderBackend makes an ImagebuilderBackend bound to an
+// existing Docker client connection. The daemon is still used to run
+// and commit containers; only the build-from-Dockerfile step is
+// reimplemented here.
+func NewImagebuilderBackend(client *docker.Client, outStream io.Writer) *ImagebuilderBackend {
+	return &ImagebuilderBackend{
+		Docker:    client,
+		OutStream: outStream,
+	}
+}
+
+// BuildImage interprets req.Dockerfile node by node, committing one
+// layer per directive other than FROM (which only selects the base
+// image), and returns the id of the final image.
+func (b *ImagebuilderBackend) BuildImage(req BuildRequest) (string, error) {
+	if req.Dockerfile == nil || len(req.Dockerfile.Children) == 0 {
+		return "", fmt.Errorf("ImagebuilderBackend: nothing to build, empty Dockerfile")
+	}
+
+	var (
+		imageID string
+		config  = &docker.Config{}
+	)
+
+	for _, node := range req.Dockerfile.Children {
+		var err error
+		if imageID, config, err = b.step(imageID, config, node, req.Options.ContextDir); err != nil {
+			return "", fmt.Errorf("ImagebuilderBackend: failed to process %s, error: %s", node.Value, err)
+		}
+	}
+
+	return imageID, nil
+}
+
+// step resolves a single Dockerfile directive against imageID/config
+// and returns the id and config to carry into the next directive.
+func (b *ImagebuilderBackend) step(imageID string, config *docker.Config, node *parser.Node, contextDir string) (string, *docker.Config, error) {
+	directive := strings.ToLower(node.Value)
+
+	switch directive {
+	case "from":
+		from := node.Next.Value
+		image, err := b.Docker.InspectImage(from)
+		if err != nil {
+			return "", nil, err
+		}
+		newConfig := *image.Config
+		return image.ID, &newConfig, nil
+
+	case "env":
+		newConfig := *config
+		newConfig.Env = append(append([]string{}, config.Env...), node.Next.Value)
+		return b.commitConfig(imageID, &newConfig, fmt.Sprintf("ENV %s", node.Next.Value))
+
+	case "label":
+		newConfig := *config
+		newConfig.Labels = map[string]string{}
+		for k, v := range config.Labels {
+			newConfig.Labels[k] = v
+		}
+		kv := strings.SplitN(node.Next.Value, "=", 2)
+		if len(kv) == 2 {
+			newConfig.Labels[kv[0]] = kv[1]
+		}
+		return b.commitConfig(imageID, &newConfig, fmt.Sprintf("LABEL %s", node.Next.Value))
+
+	case "cmd":
+		newConfig := *config
+		newConfig.Cmd = collectArgs(node.Next)
+		return b.commitConfig(imageID, &newConfig, fmt.Sprintf("CMD %v", newConfig.Cmd))
+
+	case "run":
+		return b.runStep(imageID, config, collectArgs(node.Next))
+
+	case "copy", "add":
+		return b.copyStep(imageID, config, collectArgs(node.Next), contextDir, directive)
+
+	default:
+		return "", nil, fmt.Errorf("unsupported directive for imagebuilder backend: %s", strings.ToUpper(directive))
+	}
+}
+
+// runStep executes cmd in a container started from imageID and commits
+// the resulting filesystem as a new image.
+func (b *ImagebuilderBackend) runStep(imageID string, config *docker.Config, cmd []string) (string, *docker.Config, error) {
+	runConfig := *config
+	runConfig.Image = imageID
+	runConfig.Cmd = cmd
+
+	container, err := b.CreateContainer(docker.CreateContainerOptions{
+		Config: &runConfig,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	defer b.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+
+	if err := b.StartContainer(container.ID, nil); err != nil {
+		return "", nil, err
+	}
+
+	exitCode, err := b.WaitContainer(container.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	if exitCode != 0 {
+		return "", nil, fmt.Errorf("RUN %s: exit code %d", strings.Join(cmd, " "), exitCode)
+	}
+
+	image, err := b.CommitContainer(docker.CommitContainerOptions{
+		Container: container.ID,
+		Run:       config,
+		Message:   fmt.Sprintf("RUN %s", strings.Join(cmd, " ")),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return image.ID, config, nil
+}
+
+// copyStep resolves a COPY/ADD instruction's source args against
+// contextDir, packs them into a tar stream and uploads it into a
+// container created (not started) from imageID at the resolved destination, then
+// commits the result. args is the raw directive arg list with the
+// destination as its last element; any leading "--flag=..." args (e.g.
+// COPY --from=builder) are dropped since multi-stage source images
+// aren't resolvable here.
+func (b *ImagebuilderBackend) copyStep(imageID string, config *docker.Config, args []string, contextDir string, directive string) (string, *docker.Config, error) {
+	var sources []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			continue
+		}
+		sources = append(sources, arg)
+	}
+	if len(sources) < 2 {
+		return "", nil, fmt.Errorf("%s requires at least one source and a destination", strings.ToUpper(directive))
+	}
+
+	dest := sources[len(sources)-1]
+	sources = sources[:len(sources)-1]
+
+	container, err := b.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: imageID, Cmd: []string{"true"}},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	defer b.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+
+	uploadPath := dest
+	tarEntryPrefix := ""
+	if len(sources) == 1 && !strings.HasSuffix(dest, "/") {
+		if info, err := os.Stat(filepath.Join(contextDir, sources[0])); err == nil && !info.IsDir() {
+			// A trailing slash isn't the only way dest can already be a
+			// directory: COPY app.jar /app is just as valid when /app
+			// exists as a directory in imageID, and real COPY places the
+			// file inside it rather than renaming it to "/app". Ask the
+			// container itself rather than guessing from dest's spelling
+			// alone, since that's the only way to know which case this is.
+			if !b.containerPathIsDir(container.ID, dest) {
+				uploadPath = path.Dir(dest)
+				tarEntryPrefix = path.Base(dest)
+			}
+		}
+	}
+
+	tarStream, err := tarFromSources(contextDir, sources, tarEntryPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := b.UploadToContainer(container.ID, docker.UploadToContainerOptions{
+		InputStream: tarStream,
+		Path:        uploadPath,
+	}); err != nil {
+		return "", nil, fmt.Errorf("%s %s: %s", strings.ToUpper(directive), strings.Join(sources, " "), err)
+	}
+
+	image, err := b.CommitContainer(docker.CommitContainerOptions{
+		Container: container.ID,
+		Run:       config,
+		Message:   fmt.Sprintf("%s %s", strings.ToUpper(directive), strings.Join(args, " ")),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return image.ID, config, nil
+}
+
+// containerPathIsDir reports whether path already exists as a directory
+// inside containerID, by asking the backend to tar it up and looking at
+// the type flag of the first (root) entry. A copy error (path doesn't
+// exist) is treated as "not a directory", the same as a plain file
+// would be.
+func (b *ImagebuilderBackend) containerPathIsDir(containerID, destPath string) bool {
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		err := b.CopyFromContainer(docker.CopyFromContainerOptions{
+			OutputStream: pipeWriter,
+			Container:    containerID,
+			Resource:     destPath,
+		})
+		pipeWriter.CloseWithError(err)
+	}()
+	defer io.Copy(ioutil.Discard, pipeReader)
+
+	header, err := tar.NewReader(pipeReader).Next()
+	if err != nil {
+		return false
+	}
+
+	return header.Typeflag == tar.TypeDir
+}
+
+// tarFromSources packs the files/directories in sources (resolved
+// against contextDir) into an in-memory tar stream. If rename is set,
+// sources must contain exactly one file and its tar entry is written
+// under that name instead of its original basename, so a single-file
+// COPY/ADD lands under the destination's own filename.
+func tarFromSources(contextDir string, sources []string, rename string) (io.Reader, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, src := range sources {
+		fullPath := filepath.Join(contextDir, src)
+
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			name := info.Name()
+			if rename != "" {
+				name = rename
+			}
+			if err := tarWriteFile(tw, fullPath, name, info); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		err = filepath.Walk(fullPath, func(walkPath string, walkInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if walkInfo.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(fullPath, walkPath)
+			if err != nil {
+				return err
+			}
+			return tarWriteFile(tw, walkPath, filepath.ToSlash(rel), walkInfo)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
+
+func tarWriteFile(tw *tar.Writer, fullPath, entryName string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = entryName
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// commitConfig commits a config-only change (ENV, LABEL, CMD, ...)
+// without running anything in a container.
+func (b *ImagebuilderBackend) commitConfig(imageID string, config *docker.Config, message string) (string, *docker.Config, error) {
+	container, err := b.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: imageID, Cmd: []string{"true"}},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	defer b.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+
+	image, err := b.CommitContainer(docker.CommitContainerOptions{
+		Container: container.ID,
+		Run:       config,
+		Message:   message,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return image.ID, config, nil
+}
+
+// PullImage delegates to the Docker client unchanged; pulling remains a
+// daemon operation even in the daemonless build path.
+func (b *ImagebuilderBackend) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	return b.Docker.PullImage(opts, auth)
+}
+
+// PushImage delegates to the Docker client unchanged.
+func (b *ImagebuilderBackend) PushImage(opts docker.PushImageOptions, auth docker.AuthConfiguration) error {
+	return b.Docker.PushImage(opts, auth)
+}
+
+// InspectImage delegates to the Docker client unchanged.
+func (b *ImagebuilderBackend) InspectImage(name string) (*docker.Image, error) {
+	return b.Docker.InspectImage(name)
+}
+
+// ListImages delegates to the Docker client unchanged.
+func (b *ImagebuilderBackend) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	return b.Docker.ListImages(opts)
+}
+
+// CreateContainer delegates to the Docker client unchanged; the daemon
+// still owns container lifecycle even in the daemonless build path.
+func (b *ImagebuilderBackend) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	return b.Docker.CreateContainer(opts)
+}
+
+// RemoveContainer delegates to the Docker client unchanged.
+func (b *ImagebuilderBackend) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	return b.Docker.RemoveContainer(opts)
+}
+
+// StartContainer delegates to the Docker client unchanged.
+func (b *ImagebuilderBackend) StartContainer(id string, hostConfig *docker.HostConfig) error {
+	return b.Docker.StartContainer(id, hostConfig)
+}
+
+// WaitContainer delegates to the Docker client unchanged.
+func (b *ImagebuilderBackend) WaitContainer(id string) (int, error) {
+	return b.Docker.WaitContainer(id)
+}
+
+// CommitContainer delegates to the Docker client unchanged.
+func (b *ImagebuilderBackend) CommitContainer(opts docker.CommitContainerOptions) (*docker.Image, error) {
+	return b.Docker.CommitContainer(opts)
+}
+
+// CopyFromContainer delegates to the Docker client unchanged.
+func (b *ImagebuilderBackend) CopyFromContainer(opts docker.CopyFromContainerOptions) error {
+	return b.Docker.CopyFromContainer(opts)
+}
+
+// UploadToContainer delegates to the Docker client unchanged.
+func (b *ImagebuilderBackend) UploadToContainer(container string, opts docker.UploadToContainerOptions) error {
+	return b.Docker.UploadToContainer(container, opts)
+}
+
+func collectArgs(n *parser.Node) []string {
+	var args []string
+	for ; n != nil; n = n.Next {
+		args = append(args, n.Value)
+	}
+	return args
+}
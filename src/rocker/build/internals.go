@@ -18,16 +18,13 @@ package build
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
-	"time"
 
 	"rocker/dockerclient"
 	"rocker/imagename"
@@ -37,10 +34,6 @@ import (
 	"github.com/fsouza/go-dockerclient"
 )
 
-var (
-	captureImageID = regexp.MustCompile("Successfully built ([a-z0-9]{12})")
-)
-
 func (builder *Builder) checkDockerignore() (err error) {
 	ignoreLines := []string{
 		".dockerignore",
@@ -130,6 +123,24 @@ func (builder *Builder) runDockerfile() (err error) {
 		builder.dockerfile.Children = append([]*parser.Node{fromNode}, builder.dockerfile.Children...)
 	}
 
+	// Compute the content-addressable cache key for this batch of
+	// instructions before we mutate builder.dockerfile/Config below, and
+	// stamp it as a label so a later probeCache() can find this image by
+	// a single lookup instead of scanning every local image.
+	var cacheKey string
+	if builder.UtilizeCache {
+		var err error
+		if cacheKey, err = builder.currentCacheKey(); err != nil {
+			return err
+		}
+		builder.dockerfile.Children = append(builder.dockerfile.Children, &parser.Node{
+			Value: "label",
+			Next: &parser.Node{
+				Value: fmt.Sprintf("%s=%s", cacheKeyLabel, cacheKey),
+			},
+		})
+	}
+
 	// Write Dockerfile to a context
 	dockerfileName := builder.dockerfileName()
 	dockerfilePath := path.Join(builder.ContextDir, dockerfileName)
@@ -147,52 +158,26 @@ func (builder *Builder) runDockerfile() (err error) {
 	// TODO: here we can make a hint to a user, if the context directory is very large,
 	// suggest to add some stuff to .dockerignore, etc
 
-	pipeReader, pipeWriter := io.Pipe()
-
-	var buf bytes.Buffer
-	outStream := io.MultiWriter(pipeWriter, &buf)
-
 	// TODO: consider ForceRmTmpContainer: true
 	opts := docker.BuildImageOptions{
 		Dockerfile:    dockerfileName,
-		OutputStream:  outStream,
 		ContextDir:    builder.ContextDir,
 		NoCache:       !builder.UtilizeCache,
 		Auth:          *builder.Auth,
 		RawJSONStream: true,
+		Platform:      builder.platform,
 	}
 
-	errch := make(chan error)
-
-	go func() {
-		err := builder.Docker.BuildImage(opts)
-
-		if err := pipeWriter.Close(); err != nil {
-			fmt.Fprintf(builder.OutStream, "pipeWriter.Close() err: %s\n", err)
-		}
-
-		errch <- err
-	}()
-
-	if err := jsonmessage.DisplayJSONMessagesStream(pipeReader, builder.OutStream, builder.fdOut, builder.isTerminalOut); err != nil {
-		return fmt.Errorf("Failed to process json stream error: %s", err)
-	}
-
-	if err := <-errch; err != nil {
-		return fmt.Errorf("Failed to build image: %s", err)
-	}
-
-	// It is the best way to have built image id so far
-	// The other option would be to tag the image, and then remove the tag
-	// http://stackoverflow.com/questions/19776308/get-image-id-from-image-created-via-remote-api
-	matches := captureImageID.FindStringSubmatch(buf.String())
-	if len(matches) == 0 {
-		return fmt.Errorf("Couldn't find image id out of docker build output")
+	imageID, err := builder.Backend.BuildImage(BuildRequest{
+		Dockerfile: builder.dockerfile,
+		Options:    opts,
+	})
+	if err != nil {
+		return err
 	}
-	imageID := matches[1]
 
 	// Retrieve image id
-	image, err := builder.Docker.InspectImage(imageID)
+	image, err := builder.Backend.InspectImage(imageID)
 	if err != nil {
 		// fix go-dockerclient non descriptive error
 		if err.Error() == "no such image" {
@@ -204,6 +189,14 @@ func (builder *Builder) runDockerfile() (err error) {
 	builder.imageID = image.ID
 	builder.Config = image.Config
 
+	// Back the label up in the local cache index too, so a hit survives
+	// a daemon/registry that strips labels on push/pull.
+	if cacheKey != "" && builder.cache != nil {
+		if err := builder.cache.put(cacheKey, builder.imageID); err != nil {
+			return err
+		}
+	}
+
 	// clean it up
 	builder.dockerfile = &parser.Node{}
 
@@ -241,7 +234,12 @@ func (builder *Builder) probeCache() (bool, error) {
 		return false, nil
 	}
 
-	cache, err := builder.imageGetCached(builder.imageID, builder.Config)
+	key, err := builder.currentCacheKey()
+	if err != nil {
+		return false, err
+	}
+
+	cache, err := builder.imageGetCachedByKey(key)
 	if err != nil {
 		return false, err
 	}
@@ -256,68 +254,26 @@ func (builder *Builder) probeCache() (bool, error) {
 	return true, nil
 }
 
-func (builder *Builder) imageGetCached(imageID string, config *docker.Config) (*docker.Image, error) {
-	// Retrieve all images
-	images, err := builder.Docker.ListImages(docker.ListImagesOptions{All: true})
+// currentCacheKey computes the content-addressable cache key for the
+// instruction about to run on top of builder.imageID: the parent image
+// id, the instruction's own (already-mutated) config, and, for
+// COPY/ADD, a tar-sum over the actual resolved source files (not the
+// unrelated MOUNT bind list) so that editing a copied file's contents
+// busts the cache even when the instruction text itself didn't change.
+func (builder *Builder) currentCacheKey() (string, error) {
+	instruction, err := RockerfileAstToString(builder.dockerfile)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	var siblings []string
-	for _, img := range images {
-		if img.ParentID != imageID {
-			continue
+	var sourcesSum string
+	if sources := collectCopyAddSources(builder.dockerfile); len(sources) > 0 {
+		if sourcesSum, err = tarSumFiles(builder.ContextDir, sources); err != nil {
+			return "", err
 		}
-		siblings = append(siblings, img.ID)
 	}
 
-	// Loop on the children of the given image and check the config
-	var match *docker.Image
-
-	if len(siblings) == 0 {
-		return match, nil
-	}
-
-	// TODO: ensure goroutines die if return abnormally
-
-	ch := make(chan *docker.Image)
-	errch := make(chan error)
-	numResponses := 0
-
-	for _, siblingID := range siblings {
-		go func(siblingID string) {
-			image, err := builder.Docker.InspectImage(siblingID)
-			if err != nil {
-				errch <- err
-				return
-			}
-			ch <- image
-		}(siblingID)
-	}
-
-	for {
-		select {
-		case image := <-ch:
-			if CompareConfigs(&image.ContainerConfig, config) {
-				if match == nil || match.Created.Before(image.Created) {
-					match = image
-				}
-			}
-
-			numResponses++
-
-			if len(siblings) == numResponses {
-				return match, nil
-			}
-
-		case err := <-errch:
-			return nil, err
-
-		case <-time.After(10 * time.Second):
-			// TODO: return "cache didn't hit"?
-			return nil, fmt.Errorf("Timeout while fetching cached images")
-		}
-	}
+	return computeCacheKey(builder.imageID, instruction, builder.Config, sourcesSum)
 }
 
 func (builder *Builder) getContextMountSrc(sourcePath string) (string, error) {
@@ -331,8 +287,22 @@ func (builder *Builder) getContextMountSrc(sourcePath string) (string, error) {
 }
 
 func (builder *Builder) ensureImage(imageName string, purpose string) error {
-	_, err := builder.Docker.InspectImage(imageName)
-	if err != nil && err.Error() == "no such image" {
+	existing, err := builder.Backend.InspectImage(imageName)
+
+	notFound := err != nil && err.Error() == "no such image"
+	if err != nil && !notFound {
+		return err
+	}
+
+	// A tag found locally isn't necessarily good enough: if we're doing
+	// a multi-platform build, an earlier platform may have already
+	// pulled this same tag for its own architecture. Re-pull whenever
+	// the local image's platform doesn't match the one we're building
+	// for, so each platform gets its own arch-correct base instead of
+	// silently reusing whatever the first platform fetched.
+	staleForPlatform := err == nil && builder.platform != "" && !imagePlatformMatches(existing, builder.platform)
+
+	if notFound || staleForPlatform {
 		fmt.Fprintf(builder.OutStream, "[Rocker] Pulling image: %s for %s\n", imageName, purpose)
 
 		image := imagename.NewFromString(imageName)
@@ -345,12 +315,13 @@ func (builder *Builder) ensureImage(imageName string, purpose string) error {
 			Tag:           image.GetTag(),
 			OutputStream:  pipeWriter,
 			RawJSONStream: true,
+			Platform:      builder.platform,
 		}
 
 		errch := make(chan error)
 
 		go func() {
-			err := builder.Docker.PullImage(pullOpts, *builder.Auth)
+			err := builder.Backend.PullImage(pullOpts, *builder.Auth)
 
 			if err := pipeWriter.Close(); err != nil {
 				fmt.Fprintf(builder.OutStream, "pipeWriter.Close() err: %s\n", err)
@@ -366,18 +337,31 @@ func (builder *Builder) ensureImage(imageName string, purpose string) error {
 		if err := <-errch; err != nil {
 			return fmt.Errorf("Failed to pull image: %s, error: %s", image, err)
 		}
-	} else if err != nil {
-		return err
 	}
 	return nil
 }
 
+// imagePlatformMatches reports whether image (as already pulled/built
+// locally) matches platform (an "os/arch" string like "linux/arm64"; a
+// missing os segment defaults to "linux", matching how the registry v2
+// manifest list schema treats it).
+func imagePlatformMatches(image *docker.Image, platform string) bool {
+	parts := strings.SplitN(platform, "/", 2)
+	wantOS, wantArch := "linux", parts[0]
+	if len(parts) == 2 {
+		wantOS, wantArch = parts[0], parts[1]
+	}
+
+	return strings.EqualFold(image.Architecture, wantArch) &&
+		(image.OS == "" || strings.EqualFold(image.OS, wantOS))
+}
+
 func (builder *Builder) pushImage(image imagename.ImageName) error {
 	pipeReader, pipeWriter := io.Pipe()
 	errch := make(chan error)
 
 	go func() {
-		err := builder.Docker.PushImage(docker.PushImageOptions{
+		err := builder.Backend.PushImage(docker.PushImageOptions{
 			Name:          image.NameWithRegistry(),
 			Tag:           image.GetTag(),
 			Registry:      image.Registry,
@@ -409,11 +393,15 @@ func (builder *Builder) makeExportsContainer() (string, error) {
 	}
 	exportsContainerName := builder.exportsContainerName()
 
+	// EXPORT/IMPORT no longer shuttle files through an rsync helper
+	// container; they stream tar archives directly between containers
+	// via tarStreamExport. The exports container only needs to exist to
+	// hold the shared exportsVolume, so it no longer needs the rsync
+	// binary or its image.
 	containerConfig := &docker.Config{
-		Image: rsyncImage,
+		Image: exportsHelperImage,
 		Volumes: map[string]struct{}{
-			"/opt/rsync/bin": struct{}{},
-			exportsVolume:    struct{}{},
+			exportsVolume: struct{}{},
 		},
 		Labels: map[string]string{
 			"Rockerfile": builder.Rockerfile,
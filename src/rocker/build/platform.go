@@ -0,0 +1,382 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"rocker/imagename"
+	"rocker/parser"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	manifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	manifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// manifestListPlatform is the "platform" object of a manifest list
+// entry, as defined by the registry v2 manifest list schema.
+type manifestListPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// manifestListEntry points a manifest list at one of its per-platform
+// manifests.
+type manifestListEntry struct {
+	MediaType string               `json:"mediaType"`
+	Size      int64                `json:"size"`
+	Digest    string               `json:"digest"`
+	Platform  manifestListPlatform `json:"platform"`
+}
+
+// manifestList is the schema2 manifest list document pushed so a single
+// tag can resolve to a different per-arch image depending on who pulls
+// it, the same way `docker manifest create`/`buildah manifest` do.
+type manifestList struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	MediaType     string              `json:"mediaType"`
+	Manifests     []manifestListEntry `json:"manifests"`
+}
+
+// platformTag derives the per-arch tag a single-platform build gets
+// pushed under, e.g. "latest" + "linux/arm64" -> "latest-linux-arm64".
+func platformTag(tag, platform string) string {
+	return tag + "-" + strings.Replace(platform, "/", "-", -1)
+}
+
+// buildMultiPlatform runs runDockerfile once per entry in
+// builder.Platforms, threading the platform through to the Docker
+// build API (and, transitively, to ensureImage's pulls), and returns
+// the list of images it produced, one per platform.
+func (builder *Builder) buildMultiPlatform() ([]docker.Image, error) {
+	if len(builder.Platforms) == 0 {
+		if err := builder.runDockerfile(); err != nil {
+			return nil, err
+		}
+		image, err := builder.Backend.InspectImage(builder.imageID)
+		if err != nil {
+			return nil, err
+		}
+		return []docker.Image{*image}, nil
+	}
+
+	rootDockerfile := builder.dockerfile
+	rootImageID := builder.imageID
+
+	images := make([]docker.Image, 0, len(builder.Platforms))
+
+	for _, platform := range builder.Platforms {
+		fmt.Fprintf(builder.OutStream, "[Rocker] Building for platform: %s\n", platform)
+
+		// runDockerfile mutates dockerfile.Children in place (appending
+		// the synthetic FROM/LABEL nodes, then resetting it once done);
+		// since rootDockerfile is shared across iterations, hand each
+		// platform its own clone so one platform's injected nodes don't
+		// leak into the next platform's build or cache key.
+		builder.dockerfile = cloneDockerfileRoot(rootDockerfile)
+		builder.imageID = rootImageID
+		builder.platform = platform
+
+		if err := builder.runDockerfile(); err != nil {
+			return nil, fmt.Errorf("Failed to build for platform %s, error: %s", platform, err)
+		}
+
+		image, err := builder.Backend.InspectImage(builder.imageID)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, *image)
+	}
+
+	builder.platform = ""
+
+	return images, nil
+}
+
+// cloneDockerfileRoot makes a shallow copy of root and its Children
+// slice, so appending to the clone's Children (as runDockerfile does)
+// never mutates root's own Children slice or its elements.
+func cloneDockerfileRoot(root *parser.Node) *parser.Node {
+	clone := *root
+	clone.Children = append([]*parser.Node{}, root.Children...)
+	return &clone
+}
+
+// pushMultiPlatform pushes one image per builder.Platforms entry under
+// its own per-arch tag, then assembles and pushes a manifest list that
+// points image at whichever per-arch image matches the puller's
+// platform. It reuses image as the base repo:tag, parsed the same way
+// the single-platform push path does, so `rocker build --push` keeps
+// working with a plain "repo:tag" on the CLI.
+func (builder *Builder) pushMultiPlatform(image imagename.ImageName, platformImages []docker.Image) error {
+	tag := image.GetTag()
+
+	entries := make([]manifestListEntry, 0, len(builder.Platforms))
+
+	for i, platform := range builder.Platforms {
+		archTag := imagename.NewFromString(image.NameWithRegistry() + ":" + platformTag(tag, platform))
+
+		if err := builder.pushImage(*archTag); err != nil {
+			return fmt.Errorf("Failed to push platform image %s, error: %s", archTag, err)
+		}
+
+		entry, err := builder.fetchManifestEntry(*archTag, platformImages[i], platform)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch manifest for %s, error: %s", archTag, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return builder.pushManifestList(image, entries)
+}
+
+// fetchManifestEntry reads back the manifest Rocker just pushed for
+// archImage so the manifest list can reference it by digest and size,
+// and fills in the platform object by parsing platform ("os/arch").
+func (builder *Builder) fetchManifestEntry(archImage imagename.ImageName, img docker.Image, platform string) (manifestListEntry, error) {
+	parts := strings.SplitN(platform, "/", 2)
+	os, arch := "linux", parts[0]
+	if len(parts) == 2 {
+		os, arch = parts[0], parts[1]
+	}
+
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", archImage.Registry, archImage.Name, archImage.GetTag())
+
+	resp, err := registryDo("GET", url, nil, "", *builder.Auth)
+	if err != nil {
+		return manifestListEntry{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return manifestListEntry{}, fmt.Errorf("registry returned %s for %s", resp.Status, url)
+	}
+
+	return manifestListEntry{
+		MediaType: manifestMediaType,
+		Size:      resp.ContentLength,
+		Digest:    resp.Header.Get("Docker-Content-Digest"),
+		Platform: manifestListPlatform{
+			Architecture: arch,
+			OS:           os,
+		},
+	}, nil
+}
+
+// pushManifestList PUTs the schema2 manifest list for image, pointing
+// at entries, to the registry's v2 API.
+func (builder *Builder) pushManifestList(image imagename.ImageName, entries []manifestListEntry) error {
+	list := manifestList{
+		SchemaVersion: 2,
+		MediaType:     manifestListMediaType,
+		Manifests:     entries,
+	}
+
+	body, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", image.Registry, image.Name, image.GetTag())
+
+	resp, err := registryDo("PUT", url, body, manifestListMediaType, *builder.Auth)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry rejected manifest list for %s: %s", image, resp.Status)
+	}
+
+	fmt.Fprintf(builder.OutStream, "[Rocker] Pushed manifest list %s for %d platform(s)\n", image, len(entries))
+
+	return nil
+}
+
+// bearerChallenge holds the parameters of a WWW-Authenticate: Bearer
+// challenge, the token-auth scheme Docker Hub and effectively every
+// hosted registry requires on /v2/ endpoints instead of accepting HTTP
+// Basic directly.
+type bearerChallenge struct {
+	realm, service, scope string
+}
+
+// parseBearerChallenge parses a WWW-Authenticate response header of the
+// form `Bearer realm="...",service="...",scope="..."`.
+func parseBearerChallenge(header string) (*bearerChallenge, bool) {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, false
+	}
+
+	// split on commas outside quotes only, since a scope value such as
+	// "repository:foo:pull,push" contains a comma of its own
+	rest := strings.TrimPrefix(header, "Bearer ")
+	var parts []string
+	inQuote, start := false, 0
+	for i, r := range rest {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case r == ',' && !inQuote:
+			parts = append(parts, rest[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, rest[start:])
+
+	c := &bearerChallenge{}
+	for _, part := range parts {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.Trim(kv[1], `"`)
+		switch kv[0] {
+		case "realm":
+			c.realm = v
+		case "service":
+			c.service = v
+		case "scope":
+			c.scope = v
+		}
+	}
+
+	if c.realm == "" {
+		return nil, false
+	}
+	return c, true
+}
+
+// fetchBearerToken exchanges auth for a short-lived bearer token scoped
+// to challenge — the same token dance the Docker daemon (and
+// go-dockerclient, for its own push/pull requests) performs internally
+// against registries that require it; go-dockerclient doesn't expose
+// that flow for arbitrary registry API calls like a manifest list PUT,
+// so it's reimplemented here against the standard realm/service/scope
+// challenge format.
+func fetchBearerToken(challenge *bearerChallenge, auth docker.AuthConfiguration) (string, error) {
+	req, err := http.NewRequest("GET", challenge.realm, nil)
+	if err != nil {
+		return "", err
+	}
+
+	q := req.URL.Query()
+	if challenge.service != "" {
+		q.Set("service", challenge.service)
+	}
+	if challenge.scope != "" {
+		q.Set("scope", challenge.scope)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint %s returned %s", challenge.realm, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// registryDo performs method/url against a registry, first trying
+// whatever credentials auth provides directly (HTTP Basic, or none),
+// and, if the registry challenges with `WWW-Authenticate: Bearer`,
+// retrying once with a token fetched for that challenge. This is the
+// standard registry v2 auth flow; without it, every hosted registry
+// (Docker Hub included) 401s the very first request.
+func registryDo(method, url string, body []byte, contentType string, auth docker.AuthConfiguration) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, url, r)
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Accept", manifestMediaType)
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	challenge, ok := parseBearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok {
+		return resp, nil
+	}
+
+	token, err := fetchBearerToken(challenge, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return http.DefaultClient.Do(req)
+}